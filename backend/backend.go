@@ -0,0 +1,272 @@
+// Package backend defines sgp's pluggable LanguageBackend registry:
+// the mapping from a single language-specific proto rule (e.g. a
+// go_proto_library) to the generated file(s) Bazel produces for it.
+// Programs that vendor sgp as a library (rather than running the sgp
+// binary directly) import this package and call Register from their
+// own init() to support rule kinds sgp doesn't know about out of the
+// box, the way gazelle's language plugins register themselves.
+package backend
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	goProtoLibrary     = "go_proto_library"
+	tsProtoLibrary     = "ts_proto_library"
+	javaProtoLibrary   = "java_proto_library"
+	pyProtoLibrary     = "py_proto_library"
+	ccProtoLibrary     = "cc_proto_library"
+	goGrpcLibrary      = "go_grpc_library"
+	tsGrpcLibrary      = "ts_grpc_library"
+	grpcGatewayLibrary = "grpc_gateway_library"
+)
+
+// LinkPair is a single symlink sgp needs to create: Link is the
+// workspace path IDE tooling expects to find the generated file at,
+// Target is where Bazel actually writes it under bazel-bin.
+type LinkPair struct {
+	Link, Target string
+}
+
+// LanguageProtoRule describes one instance of a language-specific proto
+// rule (e.g. a single go_proto_library target) as discovered from a
+// BUILD file or `bazel cquery`, with just enough information for a
+// LanguageBackend to compute that rule's generated outputs.
+type LanguageProtoRule struct {
+	Kind, Name, ProtoRuleName string
+	Attrs                     map[string]string
+	// OutputFiles holds this rule's actual generated outputs, as
+	// bazel-bin-relative paths (e.g. "bazel-bin/pkg/foo.pb.go"), when
+	// known from `bazel cquery`. Only populated under
+	// --discovery=cquery; nil under --discovery=build, where backends
+	// fall back to reconstructing the bazel-bin path by convention.
+	OutputFiles []string
+}
+
+// outputForSuffix returns the workspace-relative path of r's
+// cquery-reported output ending in suffix (typically the generated
+// file's basename, e.g. "foo.pb.go"), and whether one was found. It's
+// always ok=false under --discovery=build.
+func (r LanguageProtoRule) outputForSuffix(suffix string) (string, bool) {
+	for _, f := range r.OutputFiles {
+		if strings.HasSuffix(f, suffix) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// LanguageBackend maps a single language-specific proto rule (e.g. a
+// go_proto_library) to the generated file(s) Bazel produces for it, so
+// sgp can symlink them into the workspace for IDE/language-server
+// consumption. Backends are registered by RuleKind() and looked up by
+// name when a matching rule is discovered.
+type LanguageBackend interface {
+	// RuleKind returns the Bazel rule kind this backend handles, e.g.
+	// "go_proto_library".
+	RuleKind() string
+	// RequiredAttrs returns the names of the rule's attributes sgp must
+	// read and make available via LanguageProtoRule.Attrs.
+	RequiredAttrs() []string
+	// GeneratedFiles returns the symlink(s) to create for protoFile as
+	// generated by rule. Some rules (e.g. cc_proto_library) produce more
+	// than one output per proto.
+	GeneratedFiles(rule LanguageProtoRule, protoFile, workspaceRoot string) ([]LinkPair, error)
+}
+
+// Registry is the set of rule kinds sgp recognizes, keyed by Bazel rule
+// kind. Populate it via Register.
+var Registry = make(map[string]LanguageBackend)
+
+// Register adds a LanguageBackend to Registry. Downstream programs that
+// vendor sgp as a library can call this from their own init() to
+// support additional rule kinds (e.g. an internal ts_proto_grpc_library
+// wrapper) without forking sgp.
+func Register(kind string, b LanguageBackend) {
+	Registry[kind] = b
+}
+
+// resolvedTarget returns rule's actual cquery-reported output ending in
+// wantBasename, if known (see LanguageProtoRule.OutputFiles), falling
+// back to heuristicTarget otherwise: under --discovery=build, or if a
+// rule produced no output by that name (e.g. a macro-wrapped rule with
+// a nonstandard layout that cquery couldn't see either).
+func resolvedTarget(rule LanguageProtoRule, workspaceRoot, wantBasename, heuristicTarget string) string {
+	if real, ok := rule.outputForSuffix(wantBasename); ok {
+		return filepath.Join(workspaceRoot, real)
+	}
+	return heuristicTarget
+}
+
+func init() {
+	Register(goProtoLibrary, &goProtoBackend{})
+	Register(tsProtoLibrary, &tsProtoBackend{})
+	Register(javaProtoLibrary, &javaProtoBackend{})
+	Register(pyProtoLibrary, &pyProtoBackend{})
+	Register(ccProtoLibrary, &ccProtoBackend{})
+	Register(goGrpcLibrary, &goGrpcBackend{})
+	Register(tsGrpcLibrary, &tsGrpcBackend{})
+	Register(grpcGatewayLibrary, &grpcGatewayBackend{})
+}
+
+type goProtoBackend struct{}
+
+func (b *goProtoBackend) RuleKind() string        { return goProtoLibrary }
+func (b *goProtoBackend) RequiredAttrs() []string { return []string{"importpath"} }
+
+func (b *goProtoBackend) GeneratedFiles(rule LanguageProtoRule, protoFile, workspaceRoot string) ([]LinkPair, error) {
+	importPath := rule.Attrs["importpath"]
+	workspaceRelativePath, err := goWorkspaceRelativePath(workspaceRoot, importPath)
+	if err != nil {
+		return nil, err
+	}
+
+	protoFileBasename := filepath.Base(protoFile)
+	protoFileRelPath := strings.TrimPrefix(protoFile, workspaceRoot)
+
+	linkSrcDir := filepath.Join(workspaceRoot, workspaceRelativePath)
+	linkSrcFile := strings.TrimSuffix(protoFileBasename, ".proto") + ".pb.go"
+	linkSrc := filepath.Join(linkSrcDir, linkSrcFile)
+
+	genProtoAbsPath := resolvedTarget(rule, workspaceRoot, linkSrcFile,
+		filepath.Join(workspaceRoot, "bazel-bin", filepath.Dir(protoFileRelPath), rule.Name+"_", importPath, linkSrcFile))
+
+	return []LinkPair{{Link: linkSrc, Target: genProtoAbsPath}}, nil
+}
+
+type tsProtoBackend struct{}
+
+func (b *tsProtoBackend) RuleKind() string        { return tsProtoLibrary }
+func (b *tsProtoBackend) RequiredAttrs() []string { return nil }
+
+func (b *tsProtoBackend) GeneratedFiles(rule LanguageProtoRule, protoFile, workspaceRoot string) ([]LinkPair, error) {
+	protoFileRelPath := strings.TrimPrefix(protoFile, workspaceRoot)
+	linkSrcFile := rule.Name + ".d.ts"
+	linkSrc := filepath.Join(workspaceRoot, filepath.Dir(protoFileRelPath), linkSrcFile)
+	genProtoAbsPath := resolvedTarget(rule, workspaceRoot, linkSrcFile,
+		filepath.Join(workspaceRoot, "bazel-bin", filepath.Dir(protoFileRelPath), linkSrcFile))
+	return []LinkPair{{Link: linkSrc, Target: genProtoAbsPath}}, nil
+}
+
+type javaProtoBackend struct{}
+
+func (b *javaProtoBackend) RuleKind() string        { return javaProtoLibrary }
+func (b *javaProtoBackend) RequiredAttrs() []string { return nil }
+
+func (b *javaProtoBackend) GeneratedFiles(rule LanguageProtoRule, protoFile, workspaceRoot string) ([]LinkPair, error) {
+	protoFileRelPath := strings.TrimPrefix(protoFile, workspaceRoot)
+	protoDir := filepath.Dir(protoFileRelPath)
+	linkSrcFile := rule.Name + "-speed.srcjar"
+	linkSrc := filepath.Join(workspaceRoot, protoDir, linkSrcFile)
+	genProtoAbsPath := resolvedTarget(rule, workspaceRoot, linkSrcFile,
+		filepath.Join(workspaceRoot, "bazel-bin", protoDir, "lib"+linkSrcFile))
+	return []LinkPair{{Link: linkSrc, Target: genProtoAbsPath}}, nil
+}
+
+type pyProtoBackend struct{}
+
+func (b *pyProtoBackend) RuleKind() string        { return pyProtoLibrary }
+func (b *pyProtoBackend) RequiredAttrs() []string { return nil }
+
+func (b *pyProtoBackend) GeneratedFiles(rule LanguageProtoRule, protoFile, workspaceRoot string) ([]LinkPair, error) {
+	protoFileRelPath := strings.TrimPrefix(protoFile, workspaceRoot)
+	protoDir := filepath.Dir(protoFileRelPath)
+	linkSrcFile := strings.TrimSuffix(filepath.Base(protoFile), ".proto") + "_pb2.py"
+	linkSrc := filepath.Join(workspaceRoot, protoDir, linkSrcFile)
+	genProtoAbsPath := resolvedTarget(rule, workspaceRoot, linkSrcFile,
+		filepath.Join(workspaceRoot, "bazel-bin", protoDir, rule.Name+"_", linkSrcFile))
+	return []LinkPair{{Link: linkSrc, Target: genProtoAbsPath}}, nil
+}
+
+type ccProtoBackend struct{}
+
+func (b *ccProtoBackend) RuleKind() string        { return ccProtoLibrary }
+func (b *ccProtoBackend) RequiredAttrs() []string { return nil }
+
+func (b *ccProtoBackend) GeneratedFiles(rule LanguageProtoRule, protoFile, workspaceRoot string) ([]LinkPair, error) {
+	protoFileRelPath := strings.TrimPrefix(protoFile, workspaceRoot)
+	protoDir := filepath.Dir(protoFileRelPath)
+	base := strings.TrimSuffix(filepath.Base(protoFile), ".proto")
+
+	var pairs []LinkPair
+	for _, suffix := range []string{".pb.h", ".pb.cc"} {
+		linkSrcFile := base + suffix
+		linkSrc := filepath.Join(workspaceRoot, protoDir, linkSrcFile)
+		genProtoAbsPath := resolvedTarget(rule, workspaceRoot, linkSrcFile,
+			filepath.Join(workspaceRoot, "bazel-bin", protoDir, rule.Name+"_", linkSrcFile))
+		pairs = append(pairs, LinkPair{Link: linkSrc, Target: genProtoAbsPath})
+	}
+	return pairs, nil
+}
+
+type goGrpcBackend struct{}
+
+func (b *goGrpcBackend) RuleKind() string        { return goGrpcLibrary }
+func (b *goGrpcBackend) RequiredAttrs() []string { return []string{"importpath"} }
+
+func (b *goGrpcBackend) GeneratedFiles(rule LanguageProtoRule, protoFile, workspaceRoot string) ([]LinkPair, error) {
+	importPath := rule.Attrs["importpath"]
+	workspaceRelativePath, err := goWorkspaceRelativePath(workspaceRoot, importPath)
+	if err != nil {
+		return nil, err
+	}
+
+	protoFileBasename := filepath.Base(protoFile)
+	protoFileRelPath := strings.TrimPrefix(protoFile, workspaceRoot)
+
+	linkSrcDir := filepath.Join(workspaceRoot, workspaceRelativePath)
+	linkSrcFile := strings.TrimSuffix(protoFileBasename, ".proto") + "_grpc.pb.go"
+	linkSrc := filepath.Join(linkSrcDir, linkSrcFile)
+
+	genProtoAbsPath := resolvedTarget(rule, workspaceRoot, linkSrcFile,
+		filepath.Join(workspaceRoot, "bazel-bin", filepath.Dir(protoFileRelPath), rule.Name+"_", importPath, linkSrcFile))
+
+	return []LinkPair{{Link: linkSrc, Target: genProtoAbsPath}}, nil
+}
+
+type tsGrpcBackend struct{}
+
+func (b *tsGrpcBackend) RuleKind() string        { return tsGrpcLibrary }
+func (b *tsGrpcBackend) RequiredAttrs() []string { return nil }
+
+func (b *tsGrpcBackend) GeneratedFiles(rule LanguageProtoRule, protoFile, workspaceRoot string) ([]LinkPair, error) {
+	protoFileRelPath := strings.TrimPrefix(protoFile, workspaceRoot)
+	protoDir := filepath.Dir(protoFileRelPath)
+
+	var pairs []LinkPair
+	for _, suffix := range []string{"_grpc_pb.d.ts", "_grpc_pb_service.d.ts"} {
+		linkSrcFile := rule.Name + suffix
+		linkSrc := filepath.Join(workspaceRoot, protoDir, linkSrcFile)
+		genProtoAbsPath := resolvedTarget(rule, workspaceRoot, linkSrcFile,
+			filepath.Join(workspaceRoot, "bazel-bin", protoDir, linkSrcFile))
+		pairs = append(pairs, LinkPair{Link: linkSrc, Target: genProtoAbsPath})
+	}
+	return pairs, nil
+}
+
+type grpcGatewayBackend struct{}
+
+func (b *grpcGatewayBackend) RuleKind() string        { return grpcGatewayLibrary }
+func (b *grpcGatewayBackend) RequiredAttrs() []string { return []string{"importpath"} }
+
+func (b *grpcGatewayBackend) GeneratedFiles(rule LanguageProtoRule, protoFile, workspaceRoot string) ([]LinkPair, error) {
+	importPath := rule.Attrs["importpath"]
+	workspaceRelativePath, err := goWorkspaceRelativePath(workspaceRoot, importPath)
+	if err != nil {
+		return nil, err
+	}
+
+	protoFileBasename := filepath.Base(protoFile)
+	protoFileRelPath := strings.TrimPrefix(protoFile, workspaceRoot)
+
+	linkSrcDir := filepath.Join(workspaceRoot, workspaceRelativePath)
+	linkSrcFile := strings.TrimSuffix(protoFileBasename, ".proto") + ".pb.gw.go"
+	linkSrc := filepath.Join(linkSrcDir, linkSrcFile)
+
+	genProtoAbsPath := resolvedTarget(rule, workspaceRoot, linkSrcFile,
+		filepath.Join(workspaceRoot, "bazel-bin", filepath.Dir(protoFileRelPath), rule.Name+"_", importPath, linkSrcFile))
+
+	return []LinkPair{{Link: linkSrc, Target: genProtoAbsPath}}, nil
+}
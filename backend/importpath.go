@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var goImportPrefix = flag.String("go-import-prefix", "", "Override the Go module prefix used to compute workspace-relative paths for importpath attributes (normally read from the workspace's go.mod or a gazelle:prefix directive)")
+
+// modulePrefixCache holds the resolved module prefix (possibly "") per
+// workspace root, since reading go.mod/BUILD is wasted work once the
+// first go_proto_library-like rule in a workspace has resolved it.
+var modulePrefixCache sync.Map
+
+var gazellePrefixRe = regexp.MustCompile(`#\s*gazelle:prefix\s+(\S+)`)
+
+// twoComponentImportHosts are hosts whose import paths reserve two path
+// components (org/repo) before the workspace-relative directory, as
+// opposed to vanity domains which reserve one.
+var twoComponentImportHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
+
+// goWorkspaceRelativePath turns a Go importpath attribute into the
+// directory sgp should symlink the generated file into, relative to
+// workspaceRoot. It prefers the workspace's own module prefix (from
+// go.mod, a gazelle:prefix directive, or --go-import-prefix) and falls
+// back to a host-based heuristic for repos without either.
+func goWorkspaceRelativePath(workspaceRoot, importPath string) (string, error) {
+	if prefix := modulePrefix(workspaceRoot); prefix != "" {
+		rel := strings.TrimPrefix(importPath, prefix)
+		if len(rel) == len(importPath) || (rel != "" && !strings.HasPrefix(rel, "/")) {
+			return "", fmt.Errorf("import %q does not start with module prefix %q", importPath, prefix)
+		}
+		return strings.TrimPrefix(rel, "/"), nil
+	}
+	return fallbackWorkspaceRelativePath(importPath)
+}
+
+func modulePrefix(workspaceRoot string) string {
+	if *goImportPrefix != "" {
+		return *goImportPrefix
+	}
+	if cached, ok := modulePrefixCache.Load(workspaceRoot); ok {
+		return cached.(string)
+	}
+	prefix := readGoModPrefix(workspaceRoot)
+	if prefix == "" {
+		prefix = readGazellePrefix(workspaceRoot)
+	}
+	modulePrefixCache.Store(workspaceRoot, prefix)
+	return prefix
+}
+
+func readGoModPrefix(workspaceRoot string) string {
+	data, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "module ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "module"))
+		}
+	}
+	return ""
+}
+
+func readGazellePrefix(workspaceRoot string) string {
+	for _, name := range []string{"BUILD.bazel", "BUILD"} {
+		data, err := ioutil.ReadFile(filepath.Join(workspaceRoot, name))
+		if err != nil {
+			continue
+		}
+		if m := gazellePrefixRe.FindSubmatch(data); m != nil {
+			return string(m[1])
+		}
+	}
+	return ""
+}
+
+// fallbackWorkspaceRelativePath strips the host and, for well-known
+// multi-tenant hosts, the following org/repo components from importPath.
+// Used when the workspace has neither a go.mod nor a gazelle:prefix
+// directive to derive the prefix from.
+func fallbackWorkspaceRelativePath(importPath string) (string, error) {
+	parts := strings.Split(importPath, "/")
+	n := 1
+	if twoComponentImportHosts[parts[0]] {
+		n = 2
+	}
+	if len(parts) <= n+1 {
+		return "", fmt.Errorf("could not figure out workspace relative path for import %q", importPath)
+	}
+	return strings.Join(parts[n+1:], "/"), nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/buildtools/build"
+
+	"github.com/vadimberezniker/sgp/backend"
+)
+
+// label identifies a Bazel target by workspace-relative package directory
+// (forward-slash separated, "" for the workspace root) and target name.
+type label struct {
+	pkg, name string
+}
+
+func (l label) String() string {
+	return fmt.Sprintf("//%s:%s", l.pkg, l.name)
+}
+
+// protoPath returns the workspace-relative path (forward-slash separated)
+// of the file this label names, used to match against the .proto files
+// sgp finds on disk.
+func (l label) protoPath() string {
+	return path.Join(l.pkg, l.name)
+}
+
+// parseLabelString resolves raw, as it appears in a BUILD file attribute
+// (e.g. "foo.proto", ":foo_proto", or "//other/pkg:foo.proto"), into a
+// label. raw is resolved relative to currentPkg unless it names its own
+// package with a "//" prefix.
+func parseLabelString(raw, currentPkg string) label {
+	if strings.HasPrefix(raw, "//") {
+		raw = raw[2:]
+		if idx := strings.Index(raw, ":"); idx >= 0 {
+			pkg, name := raw[:idx], raw[idx+1:]
+			if name == "" {
+				name = path.Base(pkg)
+			}
+			return label{pkg: pkg, name: name}
+		}
+		return label{pkg: raw, name: path.Base(raw)}
+	}
+	if strings.HasPrefix(raw, ":") {
+		return label{pkg: currentPkg, name: raw[1:]}
+	}
+	return label{pkg: currentPkg, name: raw}
+}
+
+// workspaceIndex aggregates every proto_library and language-specific
+// proto/grpc rule discovered across all BUILD and BUILD.bazel files in a
+// workspace, keyed by workspace-relative proto path rather than
+// basename. This is what lets sgp match a .proto against its rule
+// regardless of which package's BUILD file declared it, including srcs
+// entries that are labels into other packages (e.g. "//other:foo.proto").
+type workspaceIndex struct {
+	mu              sync.Mutex
+	protoPathToRule map[string]label
+	ruleToLangRules map[label][]backend.LanguageProtoRule
+	// protoPathSource and langRuleSource record which BUILD file
+	// contributed each entry above, keyed the same way, so
+	// removeBuildFile can undo exactly one file's contributions before
+	// it's re-merged after an edit. Unused outside --watch.
+	protoPathSource map[string]string
+	langRuleSource  map[label][]string
+}
+
+func newWorkspaceIndex() *workspaceIndex {
+	return &workspaceIndex{
+		protoPathToRule: make(map[string]label),
+		ruleToLangRules: make(map[label][]backend.LanguageProtoRule),
+		protoPathSource: make(map[string]string),
+		langRuleSource:  make(map[label][]string),
+	}
+}
+
+// removeBuildFile drops every proto_library and language rule that
+// mergeBuildFile previously added on behalf of buildFilePath, so it can
+// be safely re-merged after the file changes on disk without leaking
+// entries for rules it no longer declares. It's a no-op the first time a
+// BUILD file is merged.
+func (idx *workspaceIndex) removeBuildFile(buildFilePath string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for protoPath, source := range idx.protoPathSource {
+		if source == buildFilePath {
+			delete(idx.protoPathToRule, protoPath)
+			delete(idx.protoPathSource, protoPath)
+		}
+	}
+
+	for ruleLabel, sources := range idx.langRuleSource {
+		langRules := idx.ruleToLangRules[ruleLabel]
+		keptRules := langRules[:0]
+		var keptSources []string
+		for i, source := range sources {
+			if source == buildFilePath {
+				continue
+			}
+			keptRules = append(keptRules, langRules[i])
+			keptSources = append(keptSources, source)
+		}
+		if len(keptRules) == 0 {
+			delete(idx.ruleToLangRules, ruleLabel)
+			delete(idx.langRuleSource, ruleLabel)
+		} else {
+			idx.ruleToLangRules[ruleLabel] = keptRules
+			idx.langRuleSource[ruleLabel] = keptSources
+		}
+	}
+}
+
+// langRulesForProtoPath is safe to call concurrently with mergeBuildFile,
+// but only once every mergeBuildFile call it should observe has returned
+// (sgp itself ensures this by fully populating the index before querying
+// it).
+func (idx *workspaceIndex) langRulesForProtoPath(protoPath string) ([]backend.LanguageProtoRule, bool) {
+	rule, ok := idx.protoPathToRule[protoPath]
+	if !ok {
+		return nil, false
+	}
+	langRules, ok := idx.ruleToLangRules[rule]
+	return langRules, ok
+}
+
+// protoPathsForFile returns every workspace-relative proto path idx
+// currently attributes to a proto_library declared in buildFilePath,
+// regardless of which package the proto itself lives in (srcs can name a
+// file in another package). Used by --watch to find everything a BUILD
+// edit could affect without re-walking the whole workspace.
+func (idx *workspaceIndex) protoPathsForFile(buildFilePath string) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var paths []string
+	for protoPath, source := range idx.protoPathSource {
+		if source == buildFilePath {
+			paths = append(paths, protoPath)
+		}
+	}
+	return paths
+}
+
+// mergeBuildFile parses the BUILD/BUILD.bazel file at buildFilePath, whose
+// package is pkg (workspace-relative directory, forward-slash separated,
+// "" for the workspace root), and merges its proto_library and
+// language-specific rules into idx.
+func (idx *workspaceIndex) mergeBuildFile(buildFilePath, pkg string) error {
+	buildFileContents, err := ioutil.ReadFile(buildFilePath)
+	if err != nil {
+		return fmt.Errorf("could not read BUILD file %q: %v", buildFilePath, err)
+	}
+	buildFile, err := build.ParseBuild(filepath.Base(buildFilePath), buildFileContents)
+	if err != nil {
+		return fmt.Errorf("could not parse BUILD file %q: %v", buildFilePath, err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, r := range buildFile.Rules("proto_library") {
+		srcs := r.AttrStrings("srcs")
+		if srcs == nil {
+			return fmt.Errorf("%s: proto rule %q does not have srcs", buildFilePath, r.Name())
+		}
+		ruleLabel := label{pkg: pkg, name: r.Name()}
+		for _, src := range srcs {
+			protoPath := parseLabelString(src, pkg).protoPath()
+			if existing, ok := idx.protoPathToRule[protoPath]; ok && existing != ruleLabel {
+				return fmt.Errorf("%s: src file %q appears in multiple proto rules (%s and %s)", buildFilePath, src, existing, ruleLabel)
+			}
+			idx.protoPathToRule[protoPath] = ruleLabel
+			idx.protoPathSource[protoPath] = buildFilePath
+		}
+	}
+
+	for _, r := range buildFile.Rules("") {
+		b, ok := backend.Registry[r.Kind()]
+		if !ok {
+			continue
+		}
+
+		protoAttr := r.AttrString("proto")
+		if protoAttr == "" {
+			return fmt.Errorf("%s: %s rule %q missing proto attribute", buildFilePath, r.Kind(), r.Name())
+		}
+		protoRuleLabel := parseLabelString(protoAttr, pkg)
+
+		attrs := make(map[string]string)
+		for _, attr := range b.RequiredAttrs() {
+			val := r.AttrString(attr)
+			if val == "" {
+				return fmt.Errorf("%s: %s rule %q missing %s attribute", buildFilePath, r.Kind(), r.Name(), attr)
+			}
+			attrs[attr] = val
+		}
+
+		langProtoRule := backend.LanguageProtoRule{
+			Kind:          r.Kind(),
+			Name:          r.Name(),
+			ProtoRuleName: protoRuleLabel.name,
+			Attrs:         attrs,
+		}
+		idx.ruleToLangRules[protoRuleLabel] = append(idx.ruleToLangRules[protoRuleLabel], langProtoRule)
+		idx.langRuleSource[protoRuleLabel] = append(idx.langRuleSource[protoRuleLabel], buildFilePath)
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vadimberezniker/sgp/backend"
+)
+
+var discoveryMode = flag.String("discovery", "build", `Rule discovery mode: "build" statically parses BUILD files (default, fast, offline-friendly); "cquery" shells out to "bazel cquery" so rules hidden behind macros, load()-wrapped rules, and select() are still found`)
+
+// cqueryKindsPattern builds the kind() regex alternation from every
+// kind currently in backend.Registry, so a downstream backend.Register()
+// call is picked up by --discovery=cquery the same way it already is by
+// --discovery=build, instead of needing its kind added to a separate
+// hardcoded list.
+func cqueryKindsPattern() string {
+	kinds := make([]string, 0, len(backend.Registry))
+	for kind := range backend.Registry {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds, "|")
+}
+
+// cqueryCache holds one *workspaceIndex per workspace root so a `bazel
+// cquery` invocation, which walks the whole workspace, is only run once
+// per sgp invocation even though every proto file asks for rule info.
+var cqueryCache sync.Map
+
+type cqueryAttribute struct {
+	Name            string   `json:"name"`
+	StringValue     string   `json:"stringValue"`
+	StringListValue []string `json:"stringListValue"`
+}
+
+type cqueryRule struct {
+	Name      string            `json:"name"`
+	RuleClass string            `json:"ruleClass"`
+	Attribute []cqueryAttribute `json:"attribute"`
+}
+
+func (r cqueryRule) attrString(name string) string {
+	for _, a := range r.Attribute {
+		if a.Name == name {
+			return a.StringValue
+		}
+	}
+	return ""
+}
+
+func (r cqueryRule) attrStringList(name string) []string {
+	for _, a := range r.Attribute {
+		if a.Name == name {
+			return a.StringListValue
+		}
+	}
+	return nil
+}
+
+type cqueryOutput struct {
+	Results []struct {
+		Target struct {
+			Rule cqueryRule `json:"rule"`
+		} `json:"target"`
+	} `json:"results"`
+}
+
+// runCquery shells out to `bazel cquery` rooted at workspaceRoot and
+// decodes its --output=jsonproto response.
+func runCquery(workspaceRoot, query string) (*cqueryOutput, error) {
+	cmd := exec.Command("bazel", "cquery", query, "--output=jsonproto")
+	cmd.Dir = workspaceRoot
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("bazel cquery %q failed: %v: %s", query, err, stderr.String())
+	}
+	var out cqueryOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("could not parse bazel cquery output: %v", err)
+	}
+	return &out, nil
+}
+
+// runCqueryOutputFiles shells out to `bazel cquery` with
+// --output=starlark to ask Bazel for each matching target's actual
+// generated outputs, rather than reconstructing the bazel-bin path by
+// convention the way --discovery=build does. It returns the outputs
+// keyed by target label, as bazel-bin-relative paths.
+func runCqueryOutputFiles(workspaceRoot, query string) (map[label][]string, error) {
+	const filesExpr = `str(target.label) + "\t" + " ".join([f.path for f in providers(target)["DefaultInfo"].files.to_list()])`
+	cmd := exec.Command("bazel", "cquery", query, "--output=starlark", "--starlark:expr="+filesExpr)
+	cmd.Dir = workspaceRoot
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("bazel cquery %q --output=starlark failed: %v: %s", query, err, stderr.String())
+	}
+
+	outputs := make(map[label][]string)
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		ruleLabelStr, files, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		ruleLabel := parseLabelString(ruleLabelStr, "")
+		for _, f := range strings.Fields(files) {
+			outputs[ruleLabel] = append(outputs[ruleLabel], bazelBinRelativePath(f))
+		}
+	}
+	return outputs, nil
+}
+
+// bazelBinRelativePath translates an execroot-relative output path as
+// reported by `bazel cquery` (e.g.
+// "bazel-out/k8-fastbuild/bin/pkg/foo.pb.go") into the path relative to
+// the workspace's "bazel-bin" convenience symlink, which is what every
+// backend.LanguageBackend already joins workspaceRoot against.
+func bazelBinRelativePath(execrootPath string) string {
+	const marker = "/bin/"
+	if idx := strings.Index(execrootPath, marker); idx >= 0 {
+		return filepath.Join("bazel-bin", execrootPath[idx+len(marker):])
+	}
+	return execrootPath
+}
+
+// discoverWorkspaceViaCquery asks Bazel which proto_library and
+// language-specific proto/grpc rules exist in workspaceRoot, instead of
+// statically parsing BUILD files. Unlike the "build" discovery mode,
+// this sees rules defined by macros, wrapped in load(), or guarded by
+// select(), because it asks Bazel's own analysis rather than reading the
+// BUILD text. The result is cached per workspace since cquery walks the
+// whole workspace and is too slow to invoke once per proto file.
+func discoverWorkspaceViaCquery(workspaceRoot string) (*workspaceIndex, error) {
+	if cached, ok := cqueryCache.Load(workspaceRoot); ok {
+		return cached.(*workspaceIndex), nil
+	}
+
+	idx := newWorkspaceIndex()
+
+	protoOut, err := runCquery(workspaceRoot, `kind("proto_library", //...)`)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range protoOut.Results {
+		rule := res.Target.Rule
+		ruleLabel := parseLabelString(rule.Name, "")
+		for _, src := range rule.attrStringList("srcs") {
+			idx.protoPathToRule[parseLabelString(src, "").protoPath()] = ruleLabel
+		}
+	}
+
+	kindsQuery := fmt.Sprintf(`kind("(%s)", //...)`, cqueryKindsPattern())
+
+	langOut, err := runCquery(workspaceRoot, kindsQuery)
+	if err != nil {
+		return nil, err
+	}
+	outputFilesByRule, err := runCqueryOutputFiles(workspaceRoot, kindsQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range langOut.Results {
+		rule := res.Target.Rule
+		b, ok := backend.Registry[rule.RuleClass]
+		if !ok {
+			continue
+		}
+
+		protoRef := rule.attrString("proto")
+		if protoRef == "" {
+			return nil, fmt.Errorf("cquery: %s rule %q missing proto attribute", rule.RuleClass, rule.Name)
+		}
+		protoRuleLabel := parseLabelString(protoRef, "")
+		ruleLabel := parseLabelString(rule.Name, "")
+
+		attrs := make(map[string]string)
+		for _, attr := range b.RequiredAttrs() {
+			val := rule.attrString(attr)
+			if val == "" {
+				return nil, fmt.Errorf("cquery: %s rule %q missing %s attribute", rule.RuleClass, rule.Name, attr)
+			}
+			attrs[attr] = val
+		}
+
+		langProtoRule := backend.LanguageProtoRule{
+			Kind:          rule.RuleClass,
+			Name:          ruleLabel.name,
+			ProtoRuleName: protoRuleLabel.name,
+			Attrs:         attrs,
+			OutputFiles:   outputFilesByRule[ruleLabel],
+		}
+		idx.ruleToLangRules[protoRuleLabel] = append(idx.ruleToLangRules[protoRuleLabel], langProtoRule)
+	}
+
+	cqueryCache.Store(workspaceRoot, idx)
+	return idx, nil
+}
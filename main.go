@@ -3,233 +3,226 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
-	"github.com/bazelbuild/buildtools/build"
+	"github.com/vadimberezniker/sgp/backend"
 )
 
-const (
-	goProtoLibrary = "go_proto_library"
-	tsProtoLibrary = "ts_proto_library"
-)
-
-var (
-	dirs = flag.String("dirs", "", "Bazel workspaces to process")
-
-	githubRepoRe = regexp.MustCompile(`^github.com/(.+?)/(.+?)/`)
-)
+var dirs = flag.String("dirs", "", "Bazel workspaces to process")
 
-type languageProtoRule struct {
-	kind, name, protoRuleName, importPath string
+// getLinksAndTargets looks up the LanguageBackend registered for rule's
+// kind and asks it for the symlink(s) to create for protoFile.
+func getLinksAndTargets(rule backend.LanguageProtoRule, workspaceRoot, protoFile string) ([]backend.LinkPair, error) {
+	b, ok := backend.Registry[rule.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown proto rule kind %q", rule.Kind)
+	}
+	return b.GeneratedFiles(rule, protoFile, workspaceRoot)
 }
 
-func (r *languageProtoRule) getLinkAndTarget(workspaceRoot, protoFile string) (string, string, error) {
-	protoFileRelPath := strings.TrimPrefix(protoFile, workspaceRoot)
-	switch r.kind {
-	case goProtoLibrary:
-		workspaceRelativePath := githubRepoRe.ReplaceAllLiteralString(r.importPath, "")
-		if workspaceRelativePath == r.importPath {
-			return "", "", fmt.Errorf("could not figure out workspace relative path for import %q", r.importPath)
-		}
+type result struct {
+	created  int64
+	upToDate int64
+}
 
-		protoFileBasename := filepath.Base(protoFile)
+func (r *result) addCreated()  { atomic.AddInt64(&r.created, 1) }
+func (r *result) addUpToDate() { atomic.AddInt64(&r.upToDate, 1) }
 
-		linkSrcDir := filepath.Join(workspaceRoot, workspaceRelativePath)
-		if err := os.MkdirAll(linkSrcDir, 0700); err != nil {
-			return "", "", fmt.Errorf("could not make directory %q: %v", linkSrcDir, err)
+// processProtoFile compares every symlink protoFile's rules expect
+// against the filesystem and returns one symlinkReport per expected
+// symlink. It never touches the filesystem itself: what to do with a
+// report (create it, just print it, fail a check) is decided by the
+// caller based on --mode, so "dry-run" and "check" are read-only.
+func processProtoFile(workspaceRoot string, protoFile string, langRules []backend.LanguageProtoRule) ([]symlinkReport, error) {
+	var reports []symlinkReport
+	for _, langRule := range langRules {
+		linkPairs, err := getLinksAndTargets(langRule, workspaceRoot, protoFile)
+		if err != nil {
+			return nil, err
 		}
-		linkSrcFile := strings.TrimSuffix(protoFileBasename, ".proto") + ".pb.go"
-		linkSrc := filepath.Join(linkSrcDir, linkSrcFile)
-
-		genProtoAbsPath := filepath.Join(workspaceRoot, "bazel-bin", filepath.Dir(protoFileRelPath), r.name+"_", r.importPath, linkSrcFile)
 
-		return linkSrc, genProtoAbsPath, nil
-	case tsProtoLibrary:
-		linkSrc := filepath.Join(workspaceRoot, filepath.Dir(protoFileRelPath), r.name + ".d.ts")
-		genProtoAbsPath := filepath.Join(workspaceRoot, "bazel-bin", filepath.Dir(protoFileRelPath), r.name+".d.ts")
-		return linkSrc, genProtoAbsPath, nil
+		for _, pair := range linkPairs {
+			status, err := statSymlink(pair.Link, pair.Target)
+			if err != nil {
+				return nil, err
+			}
+			reports = append(reports, symlinkReport{
+				protoFile: protoFile,
+				link:      pair.Link,
+				target:    pair.Target,
+				status:    status,
+			})
+		}
 	}
-	return "", "", fmt.Errorf("unknown proto rule kind %q", r.kind)
-}
-
-type parsedBuildFile struct {
-	protoFileToRule           map[string]string
-	protoRuleToLangProtoRules map[string][]languageProtoRule
+	return reports, nil
 }
 
-func (b *parsedBuildFile) getLangProtoRulesForProto(protoFile string) ([]languageProtoRule, bool) {
-	basename := filepath.Base(protoFile)
-	protoRule, ok := b.protoFileToRule[basename]
-	if !ok {
-		return nil, false
-	}
-	langRules, ok := b.protoRuleToLangProtoRules[protoRule]
-	if !ok {
-		return nil, false
+// scanWorkspace walks workspaceRoot and returns every .proto file found
+// plus buildFilesByDir, which tracks, per package directory, which
+// build file governs it (BUILD.bazel wins over BUILD when both exist,
+// matching Bazel's own precedence).
+func scanWorkspace(workspaceRoot string) (protoFiles []string, buildFilesByDir map[string]string, err error) {
+	buildFilesByDir = make(map[string]string)
+	err = filepath.Walk(workspaceRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch filepath.Base(path) {
+		case "BUILD.bazel":
+			buildFilesByDir[filepath.Dir(path)] = path
+		case "BUILD":
+			if _, ok := buildFilesByDir[filepath.Dir(path)]; !ok {
+				buildFilesByDir[filepath.Dir(path)] = path
+			}
+		default:
+			if strings.HasSuffix(path, ".proto") {
+				protoFiles = append(protoFiles, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	return langRules, true
+	return protoFiles, buildFilesByDir, nil
 }
 
-func parseBuildFile(buildFilePath string) (*parsedBuildFile, error) {
-	buildFileContents, err := ioutil.ReadFile(buildFilePath)
+// processWorkspace symlinks generated files for every proto in
+// workspaceRoot and returns the resulting counts plus the output lines
+// to print for it ("Processing directory ..." followed by one "Created
+// symlink" line per symlink actually created, sorted for determinism
+// since protos are processed concurrently).
+func processWorkspace(workspaceRoot string) (*result, []string, error) {
+	lines := []string{fmt.Sprintf("Processing directory %s", workspaceRoot)}
+
+	_, err := os.Stat(filepath.Join(workspaceRoot, "WORKSPACE"))
 	if err != nil {
-		return nil, fmt.Errorf("could not read BUILD file %q: %v", buildFilePath, err)
+		return nil, nil, fmt.Errorf("%q does not appear to be a Bazel workspace (no WORKSPACE file): %s", workspaceRoot, err)
 	}
-	buildFile, err := build.ParseBuild(filepath.Base(buildFilePath), buildFileContents)
+
+	protoFiles, buildFilesByDir, err := scanWorkspace(workspaceRoot)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse BUILD file %q: %v", buildFilePath, err)
+		return nil, nil, err
 	}
 
-	protoFileToRule := make(map[string]string)
+	result := &result{}
 
-	protoRules := buildFile.Rules("proto_library")
-	for _, r := range protoRules {
-		srcs := r.AttrStrings("srcs")
-		if srcs == nil {
-			return nil, fmt.Errorf("%s: proto rule %q does not have have srcs", buildFilePath, r.Name())
+	var idx *workspaceIndex
+	if *discoveryMode == "cquery" {
+		idx, err = discoverWorkspaceViaCquery(workspaceRoot)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not discover rules via cquery: %v", err)
 		}
-		for _, src := range srcs {
-			if protoFileToRule[src] != "" {
-				return nil, fmt.Errorf("%s: src file %q appears in multiple proto rules", buildFilePath, src)
-			}
-			protoFileToRule[src] = r.Name()
+	} else {
+		idx = newWorkspaceIndex()
+		var buildFilePaths []string
+		for _, buildFilePath := range buildFilesByDir {
+			buildFilePaths = append(buildFilePaths, buildFilePath)
 		}
-	}
-
-	protoRuleToLangProtoRules := make(map[string][]languageProtoRule)
-
-	goProtoRules := buildFile.Rules("")
-	for _, r := range goProtoRules {
-		if r.Kind() != goProtoLibrary && r.Kind() != tsProtoLibrary {
-			continue
+		err := runPool(buildFilePaths, func(buildFilePath string) error {
+			return idx.mergeBuildFile(buildFilePath, workspaceRelativePkg(workspaceRoot, filepath.Dir(buildFilePath)))
+		})
+		if err != nil {
+			return nil, nil, err
 		}
+	}
 
-		protoRule := r.AttrString("proto")
-		if protoRule == "" {
-			return nil, fmt.Errorf("%s: go proto rule %q missing proto attribute", buildFilePath, r.Name())
-		}
-		if !strings.HasPrefix(protoRule, ":") {
-			return nil, fmt.Errorf("%s: go proto rule %q has unsupported proto reference: %s", buildFilePath, r.Name(), protoRule)
-		}
+	var reportMu sync.Mutex
+	var messages []string
+	var issues []string
+	expectedLinks := make(map[string]bool)
+	managedDirs := make(map[string]bool)
 
-		importPath := ""
-		if r.Kind() == goProtoLibrary {
-			importPath = r.AttrString("importpath")
-			if importPath == "" {
-				return nil, fmt.Errorf("%s: go proto rule %q missing importpath attribute", buildFilePath, r.Name())
-			}
+	err = runPool(protoFiles, func(protoFile string) error {
+		protoPath, err := filepath.Rel(workspaceRoot, protoFile)
+		if err != nil {
+			return fmt.Errorf("could not compute workspace-relative path for %q: %v", protoFile, err)
 		}
-
-		protoRuleName := protoRule[1:]
-		langProtoRule := languageProtoRule{
-			kind:          r.Kind(),
-			name:          r.Name(),
-			protoRuleName: protoRule[1:],
-			importPath:    importPath,
+		langRules, ok := idx.langRulesForProtoPath(filepath.ToSlash(protoPath))
+		if !ok {
+			// Not referenced by any known proto_library rule.
+			return nil
 		}
-		protoRuleToLangProtoRules[protoRuleName] = append(protoRuleToLangProtoRules[protoRuleName], langProtoRule)
-	}
-
-	return &parsedBuildFile{
-		protoFileToRule:           protoFileToRule,
-		protoRuleToLangProtoRules: protoRuleToLangProtoRules,
-	}, nil
-}
 
-type result struct {
-	created  int
-	upToDate int
-}
-
-func processProtoFile(workspaceRoot string, protoFile string, buildFile *parsedBuildFile, result *result) error {
-	langRules, ok := buildFile.getLangProtoRulesForProto(protoFile)
-	if !ok {
-		return fmt.Errorf("could not figure out go proto rule for %q", protoFile)
-	}
-
-	for _, langRule := range langRules {
-		link, linkTarget, err := langRule.getLinkAndTarget(workspaceRoot, protoFile)
+		reports, err := processProtoFile(workspaceRoot, protoFile, langRules)
 		if err != nil {
 			return err
 		}
 
-		s, err := os.Lstat(link)
-		if err == nil {
-			if s.Mode()&os.ModeSymlink == 0 {
-				return fmt.Errorf("%s already exists and is not a symlink", link)
-			}
-			existingTarget, err := os.Readlink(link)
-			if err != nil {
-				return fmt.Errorf("could not read symlink %q: %v", link, err)
+		for _, report := range reports {
+			var line string
+			switch *mode {
+			case "apply":
+				var err error
+				line, err = applyReport(report, result)
+				if err != nil {
+					return err
+				}
+			case "dry-run":
+				line = dryRunLine(report, result)
+			case "check":
+				line = checkLine(report, result)
 			}
-			// cautious for now but we should probably just overwrite the symlink
-			if existingTarget != linkTarget {
-				return fmt.Errorf("symlink %s already exists and points to a different location", link)
-			}
-			result.upToDate++
-		} else {
-			if err := os.Symlink(linkTarget, link); err != nil {
-				return fmt.Errorf("could not create symlink from %q to %q: %v", linkTarget, link, err)
-			}
-			fmt.Printf("Created symlink for %s\n", protoFile)
-			result.created++
-		}
-	}
-	return nil
-}
-
-func processWorkspace(workspaceRoot string) (*result, error) {
-	fmt.Printf("Processing directory %s\n", workspaceRoot)
 
-	_, err := os.Stat(filepath.Join(workspaceRoot, "WORKSPACE"))
-	if err != nil {
-		return nil, fmt.Errorf("%q does not appear to be a Bazel workspace (no WORKSPACE file): %s", workspaceRoot, err)
-	}
-	var protoFiles []string
-	err = filepath.Walk(workspaceRoot, func(path string, info os.FileInfo, err error) error {
-		if !strings.HasSuffix(path, ".proto") {
-			return nil
-		}
-		if err != nil {
-			return err
+			reportMu.Lock()
+			expectedLinks[report.link] = true
+			managedDirs[filepath.Dir(report.link)] = true
+			if line != "" {
+				if *mode == "check" {
+					issues = append(issues, line)
+				} else {
+					messages = append(messages, line)
+				}
+			}
+			reportMu.Unlock()
 		}
-		protoFiles = append(protoFiles, path)
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	result := &result{}
-
-	buildFiles := make(map[string]*parsedBuildFile)
-
-	for _, protoFile := range protoFiles {
-		// For now only support build files named "BUILD".
-		buildFilePath := filepath.Join(filepath.Dir(protoFile), "BUILD")
-		// Ignore protos that are not in bazel packages.
-		if _, err := os.Stat(buildFilePath); err != nil {
-			continue
+	if *prune {
+		pruneLines, err := pruneDanglingSymlinks(workspaceRoot, managedDirs, expectedLinks)
+		if err != nil {
+			return nil, nil, err
 		}
-		buildFile := buildFiles[buildFilePath]
-		if buildFile == nil {
-			buildFile, err = parseBuildFile(buildFilePath)
-			if err != nil {
-				return nil, fmt.Errorf("could not parse BUILD file %q: %v", buildFilePath, err)
-			}
-			buildFiles[buildFilePath] = buildFile
+		if *mode == "check" {
+			issues = append(issues, pruneLines...)
+		} else {
+			messages = append(messages, pruneLines...)
 		}
+	}
 
-		if err := processProtoFile(workspaceRoot, protoFile, buildFile, result); err != nil {
-			return nil, err
-		}
+	sort.Strings(messages)
+	lines = append(lines, messages...)
+
+	if *mode == "check" && len(issues) > 0 {
+		sort.Strings(issues)
+		lines = append(lines, issues...)
+		return result, lines, fmt.Errorf("%d symlink(s) out of date", len(issues))
+	}
+
+	return result, lines, nil
+}
 
+// workspaceRelativePkg returns dir's package path relative to
+// workspaceRoot, forward-slash separated, with "" denoting the
+// workspace root itself.
+func workspaceRelativePkg(workspaceRoot, dir string) string {
+	rel, err := filepath.Rel(workspaceRoot, dir)
+	if err != nil || rel == "." {
+		return ""
 	}
-	return result, nil
+	return filepath.ToSlash(rel)
 }
 
 func main() {
@@ -239,13 +232,55 @@ func main() {
 		fmt.Printf("Please specify --dirs")
 		os.Exit(1)
 	}
+	if *discoveryMode != "build" && *discoveryMode != "cquery" {
+		fmt.Printf("Unknown --discovery mode %q, must be \"build\" or \"cquery\"\n", *discoveryMode)
+		os.Exit(1)
+	}
+	if *mode != "apply" && *mode != "dry-run" && *mode != "check" {
+		fmt.Printf("Unknown --mode %q, must be \"apply\", \"dry-run\", or \"check\"\n", *mode)
+		os.Exit(1)
+	}
 
-	for _, dir := range strings.Split(*dirs, ",") {
-		result, err := processWorkspace(dir)
-		if err != nil {
-			fmt.Printf("Could not process workspace %s: %v\n", dir, err)
+	dirList := strings.Split(*dirs, ",")
+	type workspaceOutcome struct {
+		result *result
+		lines  []string
+		err    error
+	}
+	outcomes := make([]workspaceOutcome, len(dirList))
+	indices := make([]int, len(dirList))
+	for i := range dirList {
+		indices[i] = i
+	}
+
+	// Workspaces are independent of each other, so process them
+	// concurrently too; each one's output is buffered and flushed below
+	// in --dirs order so interleaved workspaces don't interleave output.
+	runPool(indices, func(i int) error {
+		result, lines, err := processWorkspace(dirList[i])
+		outcomes[i] = workspaceOutcome{result: result, lines: lines, err: err}
+		return nil
+	})
+
+	for i, dir := range dirList {
+		outcome := outcomes[i]
+		if outcome.err != nil {
+			for _, line := range outcome.lines {
+				fmt.Println(line)
+			}
+			fmt.Printf("Could not process workspace %s: %v\n", dir, outcome.err)
+			os.Exit(1)
+		}
+		for _, line := range outcome.lines {
+			fmt.Println(line)
+		}
+		fmt.Printf("SYMLINKS CREATED: %d, UP TO DATE: %d\n", outcome.result.created, outcome.result.upToDate)
+	}
+
+	if *watch {
+		if err := watchWorkspaces(dirList); err != nil {
+			fmt.Printf("Watch mode failed: %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Printf("SYMLINKS CREATED: %d, UP TO DATE: %d\n", result.created, result.upToDate)
 	}
 }
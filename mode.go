@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var mode = flag.String("mode", "apply", `Symlink mode: "apply" creates/updates symlinks (default); "dry-run" prints what would change without touching the filesystem; "check" exits non-zero if any symlink is missing or stale, for use as a CI lint gate`)
+
+var prune = flag.Bool("prune", false, "Remove generated-file symlinks under managed directories whose backing proto_library no longer exists")
+
+// generatedFileSuffixes are the symlink suffixes sgp itself creates,
+// across all registered LanguageBackends. Only symlinks with one of
+// these suffixes are candidates for --prune, so sgp never touches a
+// symlink it didn't create.
+var generatedFileSuffixes = []string{
+	"_grpc_pb_service.d.ts",
+	"_grpc_pb.d.ts",
+	"_grpc.pb.go",
+	".pb.gw.go",
+	".pb.go",
+	".d.ts",
+	"_pb2.py",
+	".pb.h",
+	".pb.cc",
+	"-speed.srcjar",
+}
+
+func hasGeneratedSuffix(name string) bool {
+	for _, suffix := range generatedFileSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// symlinkStatus describes the on-disk state of a single generated-file
+// symlink relative to what sgp expects it to be.
+type symlinkStatus int
+
+const (
+	symlinkUpToDate symlinkStatus = iota
+	symlinkMissing
+	symlinkStale
+)
+
+// symlinkReport is the outcome of comparing one expected LinkPair
+// against the filesystem, without mutating anything. processProtoFile
+// only computes reports; applying them is a separate step gated by
+// --mode, so "dry-run" and "check" never touch disk.
+type symlinkReport struct {
+	protoFile, link, target string
+	status                  symlinkStatus
+}
+
+func statSymlink(link, target string) (symlinkStatus, error) {
+	s, err := os.Lstat(link)
+	if err != nil {
+		return symlinkMissing, nil
+	}
+	if s.Mode()&os.ModeSymlink == 0 {
+		return 0, fmt.Errorf("%s already exists and is not a symlink", link)
+	}
+	existingTarget, err := os.Readlink(link)
+	if err != nil {
+		return 0, fmt.Errorf("could not read symlink %q: %v", link, err)
+	}
+	if existingTarget != target {
+		return symlinkStale, nil
+	}
+	return symlinkUpToDate, nil
+}
+
+// applyReport creates or overwrites the symlink report describes and
+// returns a "Created symlink" line if it did anything. Only called in
+// "apply" mode.
+func applyReport(report symlinkReport, result *result) (string, error) {
+	switch report.status {
+	case symlinkUpToDate:
+		result.addUpToDate()
+		return "", nil
+	case symlinkStale:
+		if err := os.Remove(report.link); err != nil {
+			return "", fmt.Errorf("could not remove stale symlink %q: %v", report.link, err)
+		}
+	}
+	linkDir := filepath.Dir(report.link)
+	if err := os.MkdirAll(linkDir, 0700); err != nil {
+		return "", fmt.Errorf("could not make directory %q: %v", linkDir, err)
+	}
+	if err := os.Symlink(report.target, report.link); err != nil {
+		return "", fmt.Errorf("could not create symlink from %q to %q: %v", report.target, report.link, err)
+	}
+	result.addCreated()
+	return fmt.Sprintf("Created symlink for %s", report.protoFile), nil
+}
+
+// dryRunLine describes what applyReport would have done, without doing it.
+func dryRunLine(report symlinkReport, result *result) string {
+	switch report.status {
+	case symlinkUpToDate:
+		result.addUpToDate()
+		return ""
+	case symlinkMissing:
+		result.addCreated()
+		return fmt.Sprintf("Would create symlink for %s", report.protoFile)
+	case symlinkStale:
+		result.addCreated()
+		return fmt.Sprintf("Would update symlink %s (currently points elsewhere, want %s)", report.link, report.target)
+	}
+	return ""
+}
+
+// checkLine reports a mismatch a "check" run should fail on; returns ""
+// for a report that's already up to date. Unlike applyReport and
+// dryRunLine, it doesn't call result.addCreated() for a mismatch: a
+// failing check run exits before the summary line is ever printed (see
+// processWorkspace), so there's nothing observing that count.
+func checkLine(report symlinkReport, result *result) string {
+	switch report.status {
+	case symlinkUpToDate:
+		result.addUpToDate()
+		return ""
+	case symlinkMissing:
+		return fmt.Sprintf("MISSING: %s (expected symlink to %s)", report.link, report.target)
+	case symlinkStale:
+		return fmt.Sprintf("STALE: %s (points elsewhere, expected %s)", report.link, report.target)
+	}
+	return ""
+}
+
+// pruneDanglingSymlinks scans managedDirs for generated-file symlinks
+// that sgp did not expect to find during this run (expectedLinks), and
+// either removes them ("apply") or reports them ("dry-run"/"check").
+func pruneDanglingSymlinks(workspaceRoot string, managedDirs map[string]bool, expectedLinks map[string]bool) ([]string, error) {
+	bazelBin := filepath.Join(workspaceRoot, "bazel-bin")
+
+	dirs := make([]string, 0, len(managedDirs))
+	for dir := range managedDirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var lines []string
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Mode()&os.ModeSymlink == 0 || !hasGeneratedSuffix(entry.Name()) {
+				continue
+			}
+			link := filepath.Join(dir, entry.Name())
+			if expectedLinks[link] {
+				continue
+			}
+			target, err := os.Readlink(link)
+			if err != nil || !strings.HasPrefix(target, bazelBin) {
+				continue
+			}
+
+			if *mode == "apply" {
+				if err := os.Remove(link); err != nil {
+					return nil, fmt.Errorf("could not remove dangling symlink %q: %v", link, err)
+				}
+				lines = append(lines, fmt.Sprintf("Pruned dangling symlink %s", link))
+			} else {
+				lines = append(lines, fmt.Sprintf("Would prune dangling symlink %s", link))
+			}
+		}
+	}
+	return lines, nil
+}
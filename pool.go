@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+	"sync"
+)
+
+var jobs = flag.Int("jobs", runtime.NumCPU(), "Number of protos/workspaces to process concurrently")
+
+// concurrency returns the number of workers to use for n items, honoring
+// --jobs but never spinning up more workers than there are items.
+func concurrency(n int) int {
+	workers := *jobs
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > n {
+		workers = n
+	}
+	return workers
+}
+
+// runPool calls fn once for every item in items, running up to
+// concurrency(len(items)) calls in flight at a time, and returns the
+// first error encountered. Workers already in flight are allowed to
+// finish; no new items are started once an error is seen.
+func runPool[T any](items []T, fn func(T) error) error {
+	workers := concurrency(len(items))
+	if workers <= 1 {
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	itemCh := make(chan T)
+	errCh := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range itemCh {
+				if err := fn(item); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, item := range items {
+		select {
+		case itemCh <- item:
+		case err := <-errCh:
+			errCh <- err
+			break feed
+		}
+	}
+	close(itemCh)
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		return err
+	}
+	return nil
+}
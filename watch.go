@@ -0,0 +1,432 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var watch = flag.Bool("watch", false, "After the initial pass, keep running and incrementally update symlinks as .proto files and BUILD/BUILD.bazel files change, for continuous IDE/language-server sync (only meaningful with --mode=apply)")
+
+const watchDebounce = 200 * time.Millisecond
+
+// isWatchedPath reports whether path is one sgp cares about: a proto
+// source, or a build file that can declare rules over one.
+func isWatchedPath(path string) bool {
+	base := filepath.Base(path)
+	return strings.HasSuffix(path, ".proto") || base == "BUILD" || base == "BUILD.bazel"
+}
+
+// watchState is the live, incrementally-updated view of one workspace
+// that watchWorkspaces keeps in sync with disk, so a changed file only
+// costs reprocessing the package it affects rather than a full re-walk.
+type watchState struct {
+	workspaceRoot   string
+	idx             *workspaceIndex
+	buildFileForDir map[string]string // dir -> the BUILD/BUILD.bazel path currently governing it
+	knownProtoFiles map[string]bool
+}
+
+// newWatchState builds the initial idx and bookkeeping for workspaceRoot.
+// Callers are expected to have already run processWorkspace (or
+// equivalent) for the initial symlink pass; newWatchState only builds the
+// state watchWorkspaces needs to react to subsequent changes.
+func newWatchState(workspaceRoot string) (*watchState, error) {
+	protoFiles, buildFilesByDir, err := scanWorkspace(workspaceRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := newWorkspaceIndex()
+	if *discoveryMode != "cquery" {
+		// In cquery mode, applyChanges never consults idx: every change
+		// triggers a full processWorkspace re-run via cquery instead, so
+		// there's no point statically parsing BUILD files here (and
+		// doing so could spuriously fail on rules cquery would have
+		// resolved through macros).
+		for dir, buildFilePath := range buildFilesByDir {
+			if err := idx.mergeBuildFile(buildFilePath, workspaceRelativePkg(workspaceRoot, dir)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	knownProtoFiles := make(map[string]bool, len(protoFiles))
+	for _, p := range protoFiles {
+		knownProtoFiles[p] = true
+	}
+
+	return &watchState{
+		workspaceRoot:   workspaceRoot,
+		idx:             idx,
+		buildFileForDir: buildFilesByDir,
+		knownProtoFiles: knownProtoFiles,
+	}, nil
+}
+
+// refreshBuildFile re-reads the BUILD/BUILD.bazel governing dir (whichever
+// currently wins, BUILD.bazel over BUILD, matching Bazel's precedence),
+// reconciling w.buildFileForDir and w.idx with whatever is on disk.
+func (w *watchState) refreshBuildFile(dir string) error {
+	previous := w.buildFileForDir[dir]
+
+	current := ""
+	if _, err := os.Stat(filepath.Join(dir, "BUILD.bazel")); err == nil {
+		current = filepath.Join(dir, "BUILD.bazel")
+	} else if _, err := os.Stat(filepath.Join(dir, "BUILD")); err == nil {
+		current = filepath.Join(dir, "BUILD")
+	}
+
+	// Clear whatever idx currently has recorded for both the previously
+	// governing file and the one about to take over (often the same
+	// file, just edited) before re-merging.
+	if previous != "" {
+		w.idx.removeBuildFile(previous)
+	}
+	if current != "" && current != previous {
+		w.idx.removeBuildFile(current)
+	}
+
+	if current == "" {
+		delete(w.buildFileForDir, dir)
+		return nil
+	}
+	if err := w.idx.mergeBuildFile(current, workspaceRelativePkg(w.workspaceRoot, dir)); err != nil {
+		return err
+	}
+	w.buildFileForDir[dir] = current
+	return nil
+}
+
+// reset rebuilds w's idx, buildFileForDir, and knownProtoFiles from the
+// current state of disk. Called after a full processWorkspace rescan so
+// later incremental updates don't keep operating against a stale index.
+func (w *watchState) reset() error {
+	fresh, err := newWatchState(w.workspaceRoot)
+	if err != nil {
+		return err
+	}
+	*w = *fresh
+	return nil
+}
+
+// applyProtoFile reconciles the symlinks protoFile's rules expect against
+// the filesystem, honoring --mode the same way processWorkspace does:
+// "apply" creates/updates them, "dry-run" and "check" only report.
+func (w *watchState) applyProtoFile(protoFile string) ([]string, error) {
+	protoPath, err := filepath.Rel(w.workspaceRoot, protoFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute workspace-relative path for %q: %v", protoFile, err)
+	}
+	langRules, ok := w.idx.langRulesForProtoPath(filepath.ToSlash(protoPath))
+	if !ok {
+		return nil, nil
+	}
+
+	reports, err := processProtoFile(w.workspaceRoot, protoFile, langRules)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &result{}
+	var lines []string
+	for _, report := range reports {
+		switch *mode {
+		case "apply":
+			line, err := applyReport(report, result)
+			if err != nil {
+				return nil, err
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+		case "dry-run":
+			if line := dryRunLine(report, result); line != "" {
+				lines = append(lines, line)
+			}
+		case "check":
+			if line := checkLine(report, result); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines, nil
+}
+
+// removeProtoFileSymlinks reconciles the symlinks a now-deleted
+// protoFile's rules expect, so generated-file links don't outlive the
+// proto that caused them to be created. As in applyProtoFile, only
+// "apply" mode actually removes anything; "dry-run" and "check" report.
+func (w *watchState) removeProtoFileSymlinks(protoFile string) ([]string, error) {
+	protoPath, err := filepath.Rel(w.workspaceRoot, protoFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute workspace-relative path for %q: %v", protoFile, err)
+	}
+	langRules, ok := w.idx.langRulesForProtoPath(filepath.ToSlash(protoPath))
+	if !ok {
+		return nil, nil
+	}
+
+	var lines []string
+	for _, langRule := range langRules {
+		linkPairs, err := getLinksAndTargets(langRule, w.workspaceRoot, protoFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range linkPairs {
+			if s, err := os.Lstat(pair.Link); err != nil || s.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			switch *mode {
+			case "apply":
+				if err := os.Remove(pair.Link); err != nil {
+					return nil, fmt.Errorf("could not remove symlink %q for deleted proto %q: %v", pair.Link, protoFile, err)
+				}
+				lines = append(lines, fmt.Sprintf("Removed symlink %s (proto deleted)", pair.Link))
+			case "dry-run":
+				lines = append(lines, fmt.Sprintf("Would remove symlink %s (proto deleted)", pair.Link))
+			case "check":
+				lines = append(lines, fmt.Sprintf("STALE: %s (proto deleted)", pair.Link))
+			}
+		}
+	}
+	return lines, nil
+}
+
+// applyChanges reconciles w with every changed path observed during one
+// debounce window and returns the output lines to print for it. A
+// deleted BUILD/BUILD.bazel file always forces a full re-scan of
+// workspaceRoot (via processWorkspace), since every symlink it governed
+// could now be orphaned. With --prune, an *edited* BUILD/BUILD.bazel
+// file forces one too: dropping a proto_library or language-rule
+// reference from a BUILD file that still exists just makes
+// langRulesForProtoPath stop returning that rule, and nothing else in
+// this incremental path knows where that rule's now-stale symlink used
+// to live in order to prune it. Without --prune, everything is handled
+// incrementally.
+func (w *watchState) applyChanges(changed map[string]bool) ([]string, error) {
+	if *discoveryMode == "cquery" {
+		cqueryCache.Delete(w.workspaceRoot)
+		_, lines, err := processWorkspace(w.workspaceRoot)
+		return lines, err
+	}
+
+	dirsToRefresh := make(map[string]bool)
+	// protoFiles is a set, not a slice: a proto can be queued both
+	// directly (fsnotify saw it change) and indirectly (it's one of the
+	// paths idx attributes to a BUILD file that changed in this same
+	// batch), and it should only be reconciled once either way.
+	protoFiles := make(map[string]bool)
+	for path := range changed {
+		base := filepath.Base(path)
+		if base == "BUILD" || base == "BUILD.bazel" {
+			dirsToRefresh[filepath.Dir(path)] = true
+		} else {
+			protoFiles[path] = true
+		}
+	}
+
+	var lines []string
+	needsFullRescan := false
+	for dir := range dirsToRefresh {
+		previous := w.buildFileForDir[dir]
+		var affectedProtoPaths []string
+		if previous != "" {
+			affectedProtoPaths = append(affectedProtoPaths, w.idx.protoPathsForFile(previous)...)
+		}
+
+		if err := w.refreshBuildFile(dir); err != nil {
+			return nil, err
+		}
+		if previous != "" && w.buildFileForDir[dir] == "" {
+			// The build file governing dir was deleted outright: fall
+			// back to a full re-scan so orphaned symlinks get pruned.
+			needsFullRescan = true
+			continue
+		}
+		if previous != "" && *prune {
+			// The build file still exists but was edited, and it may
+			// have dropped a proto_library or language-rule reference
+			// it used to declare. The incremental path below has no
+			// record of what that now-missing rule used to resolve to,
+			// so it can't prune the symlink itself; fall back to a full
+			// re-scan, which can.
+			needsFullRescan = true
+			continue
+		}
+
+		// A BUILD edit can add or drop srcs without the .proto files
+		// themselves changing, and srcs can name a proto in another
+		// package (cross-package srcs), so re-check every proto path
+		// idx attributes to this BUILD file before and after the
+		// refresh rather than just re-listing dir itself.
+		if current := w.buildFileForDir[dir]; current != "" {
+			affectedProtoPaths = append(affectedProtoPaths, w.idx.protoPathsForFile(current)...)
+		}
+		for _, protoPath := range affectedProtoPaths {
+			protoFiles[filepath.Join(w.workspaceRoot, filepath.FromSlash(protoPath))] = true
+		}
+	}
+	if needsFullRescan {
+		_, rescanLines, err := processWorkspace(w.workspaceRoot)
+		if err == nil {
+			err = w.reset()
+		}
+		return append(lines, rescanLines...), err
+	}
+
+	for protoFile := range protoFiles {
+		if _, err := os.Stat(protoFile); os.IsNotExist(err) {
+			if w.knownProtoFiles[protoFile] {
+				removed, err := w.removeProtoFileSymlinks(protoFile)
+				if err != nil {
+					return nil, err
+				}
+				lines = append(lines, removed...)
+				delete(w.knownProtoFiles, protoFile)
+			}
+			continue
+		}
+		created, err := w.applyProtoFile(protoFile)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, created...)
+		w.knownProtoFiles[protoFile] = true
+	}
+
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// addWatchesRecursive registers watcher on dir and every subdirectory, so
+// fsnotify (which isn't recursive on its own) sees events anywhere in the
+// workspace.
+func addWatchesRecursive(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// watchWorkspaces watches every workspace in dirList for .proto and
+// BUILD/BUILD.bazel changes, applying incremental symlink updates as they
+// happen. Callers are expected to have already run the initial
+// processWorkspace pass for each directory. It blocks until an
+// unrecoverable error occurs.
+func watchWorkspaces(dirList []string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not start filesystem watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	states := make(map[string]*watchState, len(dirList))
+	for _, dir := range dirList {
+		state, err := newWatchState(dir)
+		if err != nil {
+			return fmt.Errorf("could not prepare watch state for %s: %v", dir, err)
+		}
+		states[dir] = state
+		if err := addWatchesRecursive(watcher, dir); err != nil {
+			return fmt.Errorf("could not watch %s: %v", dir, err)
+		}
+	}
+
+	fmt.Println("Watching for .proto and BUILD/BUILD.bazel changes (Ctrl-C to stop)...")
+
+	// pending coalesces events per workspace across the debounce window,
+	// so e.g. a save that touches several BUILD files in quick succession
+	// is handled as one batch instead of reprocessing after every event.
+	pending := make(map[string]map[string]bool)
+	var timer *time.Timer
+	resetDebounce := func() {
+		if timer == nil {
+			timer = time.NewTimer(watchDebounce)
+			return
+		}
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(watchDebounce)
+	}
+
+	for {
+		var timerC <-chan time.Time
+		if timer != nil {
+			timerC = timer.C
+		}
+
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					addWatchesRecursive(watcher, event.Name)
+					continue
+				}
+			}
+			if !isWatchedPath(event.Name) {
+				continue
+			}
+			root := workspaceRootForPath(event.Name, states)
+			if root == "" {
+				continue
+			}
+			if pending[root] == nil {
+				pending[root] = make(map[string]bool)
+			}
+			pending[root][event.Name] = true
+			resetDebounce()
+
+		case <-timerC:
+			timer = nil
+			for root, changed := range pending {
+				lines, err := states[root].applyChanges(changed)
+				for _, line := range lines {
+					fmt.Println(line)
+				}
+				if err != nil {
+					fmt.Printf("Could not process changes in %s: %v\n", root, err)
+				}
+			}
+			pending = make(map[string]map[string]bool)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Printf("Watcher error: %v\n", err)
+		}
+	}
+}
+
+// workspaceRootForPath returns which of states' workspace roots path
+// falls under, preferring the most specific (deepest) match in case
+// workspaces are nested.
+func workspaceRootForPath(path string, states map[string]*watchState) string {
+	best := ""
+	for root := range states {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if len(root) > len(best) {
+			best = root
+		}
+	}
+	return best
+}